@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var host = flag.String("host", "http://localhost:8585", "mulchd host:port")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-host=...] <verb> [args...]\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "verbs:")
+	fmt.Fprintln(os.Stderr, "  pool-list")
+	fmt.Fprintln(os.Stderr, "  pool-info <name>")
+	fmt.Fprintln(os.Stderr, "  pool-create <name> <path> <dir|logical> [mode]")
+	fmt.Fprintln(os.Stderr, "  pool-delete <name> [--wipe]")
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+	}
+
+	verb := args[0]
+	rest := args[1:]
+
+	var err error
+	switch verb {
+	case "pool-list":
+		err = poolList()
+	case "pool-info":
+		if len(rest) != 1 {
+			usage()
+		}
+		err = poolInfo(rest[0])
+	case "pool-create":
+		if len(rest) < 3 {
+			usage()
+		}
+		mode := ""
+		if len(rest) > 3 {
+			mode = rest[3]
+		}
+		err = poolCreate(rest[0], rest[1], rest[2], mode)
+	case "pool-delete":
+		if len(rest) < 1 {
+			usage()
+		}
+		wipe := len(rest) > 1 && rest[1] == "--wipe"
+		err = poolDelete(rest[0], wipe)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func poolList() error {
+	return doRequest(http.MethodGet, "/pool", nil)
+}
+
+func poolInfo(name string) error {
+	q := url.Values{"name": {name}}
+	return doRequest(http.MethodGet, "/pool?"+q.Encode(), nil)
+}
+
+func poolCreate(name string, path string, poolType string, mode string) error {
+	form := url.Values{
+		"name": {name},
+		"path": {path},
+		"type": {poolType},
+	}
+	if mode != "" {
+		form.Set("mode", mode)
+	}
+	return doRequest(http.MethodPost, "/pool", form)
+}
+
+func poolDelete(name string, wipe bool) error {
+	q := url.Values{"name": {name}}
+	if wipe {
+		q.Set("wipe", "true")
+	}
+	return doRequest(http.MethodDelete, "/pool?"+q.Encode(), nil)
+}
+
+// doRequest hits mulchd's HTTP API and copies the response body to
+// stdout. form is sent as the request body (application/x-www-form-urlencoded)
+// when method expects one (POST); pass nil for GET/DELETE, where
+// parameters belong in path's query string instead.
+func doRequest(method string, path string, form url.Values) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, *host+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(os.Stdout, resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return nil
+}
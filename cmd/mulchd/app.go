@@ -192,21 +192,22 @@ func (app *App) initLibvirtStorage() error {
 }
 
 func (app *App) initLibvirtNetwork() error {
-	networkName := "mulch"
-
-	net, netcfg, err := app.Libvirt.GetOrCreateNetwork(
-		networkName,
-		app.Config.configPath+"/templates/network.xml",
-		app.Log)
+	specs := []NetworkSpec{
+		{
+			Name:         "mulch",
+			TemplateFile: app.Config.configPath + "/templates/network.xml",
+		},
+	}
 
+	err := app.Libvirt.GetOrCreateNetwork(specs, app.Config.AllowNetRecreate, app.Log)
 	if err != nil {
 		return fmt.Errorf("initLibvirtNetwork: %s", err)
 	}
 
-	app.Log.Info(fmt.Sprintf("network '%s': %s (%s)", netcfg.Name, netcfg.IPs[0].Address, netcfg.Bridge.Name))
-
-	app.Libvirt.Network = net
-	app.Libvirt.NetworkXML = netcfg
+	for _, spec := range specs {
+		netcfg := app.Libvirt.Networks[spec.Name].XML
+		app.Log.Info(fmt.Sprintf("network '%s': %s (%s)", netcfg.Name, netcfg.IPs[0].Address, netcfg.Bridge.Name))
+	}
 
 	return nil
 }
@@ -1,6 +1,14 @@
 package main
 
-import "github.com/Xfennec/mulch"
+import (
+	"path/filepath"
+
+	"github.com/Xfennec/mulch"
+)
+
+// hubClientBufferSize is the capacity of each client's Messages channel,
+// used as a ring buffer (see Hub.Run)
+const hubClientBufferSize = 256
 
 type Hub struct {
 	clients    map[*HubClient]bool
@@ -9,9 +17,52 @@ type Hub struct {
 	unregister chan *HubClient
 }
 
+// MessageFilter restricts the messages a HubClient receives. A nil
+// slice (or nil MessageFilter) matches everything.
+type MessageFilter struct {
+	Types   []string // allow-list of Message.Type, e.g. "INFO", "ERROR"
+	Targets []string // glob patterns matched against Message.Target
+}
+
+// Matches reports whether msg passes the filter
+func (f *MessageFilter) Matches(msg *mulch.Message) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if string(msg.Type) == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Targets) > 0 {
+		found := false
+		for _, t := range f.Targets {
+			if ok, _ := filepath.Match(t, msg.Target); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
 type HubClient struct {
 	Messages   chan *mulch.Message
 	ClientInfo string
+	Filter     *MessageFilter
 	hub        *Hub
 }
 
@@ -39,25 +90,55 @@ func (h *Hub) Run() {
 		case message := <-h.broadcast:
 			// fmt.Printf("broadcasting\n")
 			for client := range h.clients {
+				if !client.Filter.Matches(message) {
+					continue
+				}
+
 				select {
 				case client.Messages <- message:
 				default:
-					close(client.Messages)
-					delete(h.clients, client)
+					// Messages is full: the client is lagging behind, so
+					// use it as a ring buffer instead of dropping the
+					// client entirely: evict the oldest message to make
+					// room for the new one.
+					select {
+					case <-client.Messages:
+					default:
+					}
+					select {
+					case client.Messages <- message:
+					default:
+					}
 				}
 			}
 		}
 	}
 }
 
+// Broadcast sends message to every registered client whose filter matches
 func (h *Hub) Broadcast(message *mulch.Message) {
 	h.broadcast <- message
 }
 
-func (h *Hub) Register(info string) *HubClient {
+// SendTo is a convenience for point-to-point delivery (e.g. per-VM build
+// logs): it stamps message with target and fans it out through the same
+// filtered Broadcast, so it reaches clients whose target patterns match
+// it, as well as clients that have no target filter at all.
+func (h *Hub) SendTo(target string, message *mulch.Message) {
+	// copy rather than mutate the caller's message, since it may be
+	// shared (e.g. reused for several targets, or read concurrently)
+	stamped := *message
+	stamped.Target = target
+	h.Broadcast(&stamped)
+}
+
+// Register subscribes a new client to the hub. filter may be nil to
+// receive every message.
+func (h *Hub) Register(info string, filter *MessageFilter) *HubClient {
 	client := &HubClient{
-		Messages:   make(chan *mulch.Message),
+		Messages:   make(chan *mulch.Message, hubClientBufferSize),
 		ClientInfo: info,
+		Filter:     filter,
 		hub:        h,
 	}
 	h.register <- client
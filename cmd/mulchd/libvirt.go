@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 
@@ -9,14 +10,33 @@ import (
 	"github.com/libvirt/libvirt-go-xml"
 )
 
+// uploadStreamChunkSize is the buffer size used when streaming a volume
+// upload through a libvirt stream.
+const uploadStreamChunkSize = 4 * 1024 * 1024 // 4 MiB
+
 // TODO: deal with keep-alive, disconnections, etc
 
 // Libvirt is an interface to libvirt library
 type Libvirt struct {
-	conn       *libvirt.Connect
-	Pools      LibvirtPools
-	Network    *libvirt.Network
-	NetworkXML *libvirtxml.Network
+	conn     *libvirt.Connect
+	Pools    LibvirtPools
+	Networks map[string]*NetworkEntry
+}
+
+// NetworkSpec describes a mulch network to create/reconcile, so that
+// GetOrCreateNetwork can handle several isolated networks (e.g.
+// "mulch-frontend", "mulch-backend") instead of a single one.
+// initLibvirtNetwork passes only the "mulch" network; there is no user
+// configuration for other networks.
+type NetworkSpec struct {
+	Name         string
+	TemplateFile string
+}
+
+// NetworkEntry stores a live libvirt network alongside its parsed XML
+type NetworkEntry struct {
+	Network *libvirt.Network
+	XML     *libvirtxml.Network
 }
 
 // LibvirtPools stores needed libvirt Pools for mulchd
@@ -111,48 +131,513 @@ func (lv *Libvirt) GetOrCreateStoragePool(poolName string, poolPath string, temp
 	return pool, nil
 }
 
-// GetOrCreateNetwork retreives (and create, if necessary) a libvirt network
-func (lv *Libvirt) GetOrCreateNetwork(networkName string, templateFile string, log *Log) (*libvirt.Network, *libvirtxml.Network, error) {
-	net, errN := lv.conn.LookupNetworkByName(networkName)
+// GetOrCreateNetwork retrieves (and creates, if necessary) every network
+// described by specs, storing the result in lv.Networks. If a network
+// already exists but its running XML has drifted from its template
+// (bridge name, subnet, DHCP range, forward mode, DNS host entries), it
+// is only redefined when allowNetRecreate is true (--allow-net-recreate
+// on the CLI) since that implies destroying and recreating it.
+func (lv *Libvirt) GetOrCreateNetwork(specs []NetworkSpec, allowNetRecreate bool, log *Log) error {
+	if lv.Networks == nil {
+		lv.Networks = make(map[string]*NetworkEntry)
+	}
+
+	for _, spec := range specs {
+		entry, err := lv.getOrCreateOneNetwork(spec, allowNetRecreate, log)
+		if err != nil {
+			return fmt.Errorf("GetOrCreateNetwork: %s: %s", spec.Name, err)
+		}
+		lv.Networks[spec.Name] = entry
+	}
+
+	return nil
+}
+
+func (lv *Libvirt) getOrCreateOneNetwork(spec NetworkSpec, allowNetRecreate bool, log *Log) (*NetworkEntry, error) {
+	xml, err := ioutil.ReadFile(spec.TemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", spec.TemplateFile, err)
+	}
+
+	wantcfg := &libvirtxml.Network{}
+	err = wantcfg.Unmarshal(string(xml))
+	if err != nil {
+		return nil, fmt.Errorf("wantcfg.Unmarshal: %s", err)
+	}
+	wantcfg.Name = spec.Name
+
+	net, errN := lv.conn.LookupNetworkByName(spec.Name)
 	if errN != nil {
 		virtErr := errN.(libvirt.Error)
-		if virtErr.Domain == libvirt.FROM_NETWORK && virtErr.Code == libvirt.ERR_NO_NETWORK {
-			log.Info(fmt.Sprintf("network '%s' not found, it's OK, let's create it", networkName))
+		if virtErr.Domain != libvirt.FROM_NETWORK || virtErr.Code != libvirt.ERR_NO_NETWORK {
+			return nil, fmt.Errorf("Unexpected error: %s", errN)
+		}
 
-			xml, err := ioutil.ReadFile(templateFile)
-			if err != nil {
-				return nil, nil, fmt.Errorf("GetOrCreateNetwork: %s: %s", templateFile, err)
-			}
+		log.Info(fmt.Sprintf("network '%s' not found, it's OK, let's create it", spec.Name))
+		net, err = lv.defineAndStartNetwork(wantcfg)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		xmldoc, err := net.GetXMLDesc(0)
+		if err != nil {
+			return nil, fmt.Errorf("GetXMLDesc: %s", err)
+		}
 
-			net, err = lv.conn.NetworkDefineXML(string(xml))
-			if err != nil {
-				return nil, nil, fmt.Errorf("GetOrCreateNetwork: NetworkDefineXML: %s", err)
-			}
+		curcfg := &libvirtxml.Network{}
+		err = curcfg.Unmarshal(xmldoc)
+		if err != nil {
+			return nil, fmt.Errorf("curcfg.Unmarshal: %s", err)
+		}
 
-			err = net.SetAutostart(true)
-			if err != nil {
-				return nil, nil, fmt.Errorf("GetOrCreateNetwork: SetAutostart: %s", err)
-			}
+		if networkHasDrifted(curcfg, wantcfg) {
+			if !allowNetRecreate {
+				log.Warning(fmt.Sprintf("network '%s' differs from its template, use --allow-net-recreate to redefine it", spec.Name))
+			} else {
+				log.Info(fmt.Sprintf("network '%s' differs from its template, redefining it", spec.Name))
 
-			err = net.Create()
-			if err != nil {
-				return nil, nil, fmt.Errorf("GetOrCreateNetwork: Create: %s", err)
+				active, err := net.IsActive()
+				if err != nil {
+					return nil, fmt.Errorf("net.IsActive: %s", err)
+				}
+				if active {
+					err = net.Destroy()
+					if err != nil {
+						return nil, fmt.Errorf("net.Destroy: %s", err)
+					}
+				}
+
+				net, err = lv.defineAndStartNetwork(wantcfg)
+				if err != nil {
+					return nil, err
+				}
 			}
-		} else {
-			return nil, nil, fmt.Errorf("GetOrCreateNetwork: Unexpected error: %s", errN)
 		}
 	}
 
 	xmldoc, err := net.GetXMLDesc(0)
 	if err != nil {
-		return nil, nil, fmt.Errorf("GetOrCreateNetwork: GetXMLDesc: %s", err)
+		return nil, fmt.Errorf("GetXMLDesc: %s", err)
 	}
 
 	netcfg := &libvirtxml.Network{}
 	err = netcfg.Unmarshal(xmldoc)
 	if err != nil {
-		return nil, nil, fmt.Errorf("GetOrCreateNetwork: Unmarshal: %s", err)
+		return nil, fmt.Errorf("netcfg.Unmarshal: %s", err)
+	}
+
+	return &NetworkEntry{Network: net, XML: netcfg}, nil
+}
+
+func (lv *Libvirt) defineAndStartNetwork(cfg *libvirtxml.Network) (*libvirt.Network, error) {
+	out, err := cfg.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("cfg.Marshal: %s", err)
+	}
+
+	net, err := lv.conn.NetworkDefineXML(string(out))
+	if err != nil {
+		return nil, fmt.Errorf("NetworkDefineXML: %s", err)
+	}
+
+	err = net.SetAutostart(true)
+	if err != nil {
+		return nil, fmt.Errorf("SetAutostart: %s", err)
+	}
+
+	err = net.Create()
+	if err != nil {
+		return nil, fmt.Errorf("Create: %s", err)
+	}
+
+	return net, nil
+}
+
+// networkHasDrifted compares the fields that matter for mulch between
+// the running network (cur) and its template (want): bridge name,
+// forward mode, subnet/DHCP range and DNS host entries.
+func networkHasDrifted(cur *libvirtxml.Network, want *libvirtxml.Network) bool {
+	if bridgeName(cur) != bridgeName(want) {
+		return true
+	}
+
+	if forwardMode(cur) != forwardMode(want) {
+		return true
+	}
+
+	if !ipsEqual(cur.IPs, want.IPs) {
+		return true
+	}
+
+	if !dnsHostsEqual(cur.DNS, want.DNS) {
+		return true
+	}
+
+	return false
+}
+
+func bridgeName(n *libvirtxml.Network) string {
+	if n.Bridge == nil {
+		return ""
+	}
+	return n.Bridge.Name
+}
+
+func forwardMode(n *libvirtxml.Network) string {
+	if n.Forward == nil {
+		return ""
+	}
+	return n.Forward.Mode
+}
+
+func ipsEqual(a []libvirtxml.NetworkIP, b []libvirtxml.NetworkIP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Address != b[i].Address || a[i].Netmask != b[i].Netmask {
+			return false
+		}
+		if !dhcpRangesEqual(a[i].DHCP, b[i].DHCP) {
+			return false
+		}
+	}
+	return true
+}
+
+func dhcpRangesEqual(a *libvirtxml.NetworkDHCP, b *libvirtxml.NetworkDHCP) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.Ranges) != len(b.Ranges) {
+		return false
+	}
+	for i := range a.Ranges {
+		if a.Ranges[i].Start != b.Ranges[i].Start || a.Ranges[i].End != b.Ranges[i].End {
+			return false
+		}
+	}
+	return true
+}
+
+func dnsHostsEqual(a *libvirtxml.NetworkDNS, b *libvirtxml.NetworkDNS) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.Host) != len(b.Host) {
+		return false
+	}
+	for i := range a.Host {
+		if a.Host[i].IP != b.Host[i].IP {
+			return false
+		}
+		if len(a.Host[i].Hostnames) != len(b.Host[i].Hostnames) {
+			return false
+		}
+		for j := range a.Host[i].Hostnames {
+			if a.Host[i].Hostnames[j].Hostname != b.Host[i].Hostnames[j].Hostname {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// StoragePoolInfo summarizes capacity usage for a storage pool
+type StoragePoolInfo struct {
+	Name       string
+	Type       string
+	Capacity   uint64
+	Allocation uint64
+	Available  uint64
+	Autostart  bool
+}
+
+// CreateStoragePool defines, autostarts and builds a new storage pool,
+// rooted at path. poolType is "dir" (a plain directory) or "logical"
+// (an existing LVM volume group named path). Unlike GetOrCreateStoragePool,
+// this is meant for user-managed pools, so the XML is built from scratch
+// instead of coming from a template file.
+func (lv *Libvirt) CreateStoragePool(name string, path string, poolType string, mode string) (*libvirt.StoragePool, error) {
+	if poolType != "dir" && poolType != "logical" {
+		return nil, fmt.Errorf("CreateStoragePool: unsupported pool type '%s'", poolType)
+	}
+
+	targetPath := path
+	if poolType == "logical" {
+		// path is expected to already be an existing volume group name;
+		// libvirt's logical pool backend wants the /dev/<vg> device path
+		targetPath = filepath.Join("/dev", path)
+	}
+
+	poolcfg := &libvirtxml.StoragePool{
+		Type: poolType,
+		Name: name,
+		Target: &libvirtxml.StoragePoolTarget{
+			Path: targetPath,
+		},
+	}
+
+	if mode != "" {
+		poolcfg.Target.Permissions = &libvirtxml.StoragePoolTargetPermissions{
+			Mode: mode,
+		}
+	}
+
+	if poolType == "logical" {
+		poolcfg.Source = &libvirtxml.StoragePoolSource{
+			Name: path,
+		}
+	}
+
+	out, err := poolcfg.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("CreateStoragePool: poolcfg.Marshal: %s", err)
+	}
+
+	pool, err := lv.conn.StoragePoolDefineXML(string(out), 0)
+	if err != nil {
+		return nil, fmt.Errorf("CreateStoragePool: StoragePoolDefineXML: %s", err)
+	}
+
+	err = pool.SetAutostart(true)
+	if err != nil {
+		return nil, fmt.Errorf("CreateStoragePool: pool.SetAutostart: %s", err)
+	}
+
+	// WITH_BUILD = will create target directory/LV if not already there
+	err = pool.Create(libvirt.STORAGE_POOL_CREATE_WITH_BUILD)
+	if err != nil {
+		return nil, fmt.Errorf("CreateStoragePool: pool.Create: %s", err)
+	}
+
+	err = pool.Refresh(0)
+	if err != nil {
+		return nil, fmt.Errorf("CreateStoragePool: pool.Refresh: %s", err)
+	}
+
+	return pool, nil
+}
+
+// DeleteStoragePool stops and undefines a storage pool. If wipe is true,
+// every volume in the pool is deleted from disk first; otherwise the
+// pool is simply detached from libvirt, leaving its content untouched.
+func (lv *Libvirt) DeleteStoragePool(name string, wipe bool) error {
+	pool, err := lv.conn.LookupStoragePoolByName(name)
+	if err != nil {
+		return fmt.Errorf("DeleteStoragePool: LookupStoragePoolByName: %s", err)
+	}
+	defer pool.Free()
+
+	if wipe {
+		vols, err := pool.ListAllStorageVolumes(0)
+		if err != nil {
+			return fmt.Errorf("DeleteStoragePool: ListAllStorageVolumes: %s", err)
+		}
+		for _, vol := range vols {
+			err = vol.Delete(0)
+			vol.Free()
+			if err != nil {
+				return fmt.Errorf("DeleteStoragePool: vol.Delete: %s", err)
+			}
+		}
+	}
+
+	active, err := pool.IsActive()
+	if err != nil {
+		return fmt.Errorf("DeleteStoragePool: pool.IsActive: %s", err)
+	}
+	if active {
+		err = pool.Destroy()
+		if err != nil {
+			return fmt.Errorf("DeleteStoragePool: pool.Destroy: %s", err)
+		}
+	}
+
+	err = pool.Undefine()
+	if err != nil {
+		return fmt.Errorf("DeleteStoragePool: pool.Undefine: %s", err)
+	}
+
+	return nil
+}
+
+// ListStoragePools returns the names of all storage pools known to
+// libvirt, not just the built-in mulch-* pools.
+func (lv *Libvirt) ListStoragePools() ([]string, error) {
+	pools, err := lv.conn.ListAllStoragePools(0)
+	if err != nil {
+		return nil, fmt.Errorf("ListStoragePools: %s", err)
+	}
+
+	names := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		name, err := pool.GetName()
+		pool.Free()
+		if err != nil {
+			return nil, fmt.Errorf("ListStoragePools: pool.GetName: %s", err)
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// GetStoragePoolInfo returns capacity/allocation/available stats for a pool
+func (lv *Libvirt) GetStoragePoolInfo(name string) (*StoragePoolInfo, error) {
+	pool, err := lv.conn.LookupStoragePoolByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("GetStoragePoolInfo: LookupStoragePoolByName: %s", err)
+	}
+	defer pool.Free()
+
+	info, err := pool.GetInfo()
+	if err != nil {
+		return nil, fmt.Errorf("GetStoragePoolInfo: pool.GetInfo: %s", err)
+	}
+
+	xmldoc, err := pool.GetXMLDesc(0)
+	if err != nil {
+		return nil, fmt.Errorf("GetStoragePoolInfo: pool.GetXMLDesc: %s", err)
+	}
+
+	poolcfg := &libvirtxml.StoragePool{}
+	err = poolcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return nil, fmt.Errorf("GetStoragePoolInfo: poolcfg.Unmarshal: %s", err)
+	}
+
+	autostart, err := pool.GetAutostart()
+	if err != nil {
+		return nil, fmt.Errorf("GetStoragePoolInfo: pool.GetAutostart: %s", err)
+	}
+
+	return &StoragePoolInfo{
+		Name:       name,
+		Type:       poolcfg.Type,
+		Capacity:   info.Capacity,
+		Allocation: info.Allocation,
+		Available:  info.Available,
+		Autostart:  autostart,
+	}, nil
+}
+
+// LookupStoragePool looks up a storage pool (built-in or user-created)
+// by name, for callers that only have its name at hand (e.g. the
+// /volume HTTP route).
+func (lv *Libvirt) LookupStoragePool(name string) (*libvirt.StoragePool, error) {
+	pool, err := lv.conn.LookupStoragePoolByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("LookupStoragePool: %s", err)
+	}
+	return pool, nil
+}
+
+// UploadVolume creates a new volume of the given size (in bytes) in pool
+// and streams the content of r into it through a libvirt stream, instead
+// of writing directly to the pool's directory. This means mulchd no
+// longer needs to share a filesystem with the libvirt daemon, which in
+// turn allows remote LibVirtURI values like qemu+ssh:// or qemu+tcp://.
+// Upload progress is logged as a percentage of size.
+func (lv *Libvirt) UploadVolume(pool *libvirt.StoragePool, name string, r io.Reader, size uint64, log *Log) (*libvirt.StorageVol, error) {
+	volcfg := &libvirtxml.StorageVolume{
+		Name: name,
+		Capacity: &libvirtxml.StorageVolumeSize{
+			Value: size,
+			Unit:  "bytes",
+		},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format: &libvirtxml.StorageVolumeTargetFormat{
+				Type: "qcow2",
+			},
+		},
+	}
+
+	out, err := volcfg.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("UploadVolume: volcfg.Marshal: %s", err)
+	}
+
+	vol, err := pool.StorageVolCreateXML(string(out), 0)
+	if err != nil {
+		return nil, fmt.Errorf("UploadVolume: StorageVolCreateXML: %s", err)
+	}
+
+	// plain blocking stream: a STREAM_NONBLOCK stream requires retrying
+	// Send on an "operation would block" condition (typically via
+	// StreamEventAddCallback), which is unneeded complexity here since
+	// UploadVolume runs on its caller's goroutine (the HTTP request's
+	// for /volume), which can simply block until the upload is done.
+	stream, err := lv.conn.NewStream(0)
+	if err != nil {
+		vol.Delete(0)
+		return nil, fmt.Errorf("UploadVolume: NewStream: %s", err)
+	}
+
+	err = vol.Upload(stream, 0, size, 0)
+	if err != nil {
+		vol.Delete(0)
+		return nil, fmt.Errorf("UploadVolume: vol.Upload: %s", err)
+	}
+
+	sent, err := uploadStream(stream, r, size, name, log)
+	if err != nil {
+		stream.Abort()
+		vol.Delete(0)
+		return nil, err
+	}
+
+	if sent != size {
+		stream.Abort()
+		vol.Delete(0)
+		return nil, fmt.Errorf("UploadVolume: transferred %d bytes, expected %d", sent, size)
+	}
+
+	err = stream.Finish()
+	if err != nil {
+		vol.Delete(0)
+		return nil, fmt.Errorf("UploadVolume: stream.Finish: %s", err)
+	}
+
+	return vol, nil
+}
+
+// uploadStream pushes r into stream in uploadStreamChunkSize chunks,
+// retrying on short writes, and logs progress as a percentage of size.
+func uploadStream(stream *libvirt.Stream, r io.Reader, size uint64, name string, log *Log) (uint64, error) {
+	var sent uint64
+	buf := make([]byte, uploadStreamChunkSize)
+	lastPercent := -1
+
+	for {
+		n, errR := r.Read(buf)
+		if n > 0 {
+			written := 0
+			for written < n {
+				w, errS := stream.Send(buf[written:n])
+				if errS != nil {
+					return sent, fmt.Errorf("uploadStream: stream.Send: %s", errS)
+				}
+				written += w
+			}
+			sent += uint64(n)
+
+			var percent int
+			if size > 0 {
+				percent = int(sent * 100 / size)
+			}
+			if percent != lastPercent {
+				log.Infof("uploading '%s': %d%%", name, percent)
+				lastPercent = percent
+			}
+		}
+		if errR == io.EOF {
+			break
+		}
+		if errR != nil {
+			return sent, fmt.Errorf("uploadStream: read: %s", errR)
+		}
 	}
 
-	return net, netcfg, nil
+	return sent, nil
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// eventsHeartbeatInterval is how often a keep-alive comment is sent on
+// the /events SSE stream, so intermediate proxies don't close it.
+const eventsHeartbeatInterval = 15 * time.Second
+
+// AddRoutes registers all HTTP handlers on app.Mux
+func (app *App) AddRoutes() {
+	app.Mux.HandleFunc("/pool", app.poolHandler)
+	app.Mux.HandleFunc("/volume", app.volumeHandler)
+	app.Mux.HandleFunc("/log", app.logHandler)
+	app.Mux.HandleFunc("/events", app.eventsHandler)
+}
+
+// volumeHandler uploads a new volume into an existing storage pool by
+// streaming the request body through Libvirt.UploadVolume. size must be
+// the exact byte length of the body, e.g.:
+//
+//	curl -X POST --data-binary @disk.qcow2 \
+//	  "http://host/volume?pool=mulch-disks&name=myvm.qcow2&size=$(stat -c %s disk.qcow2)"
+func (app *App) volumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	poolName := r.URL.Query().Get("pool")
+	name := r.URL.Query().Get("name")
+	sizeParam := r.URL.Query().Get("size")
+
+	if poolName == "" || name == "" || sizeParam == "" {
+		http.Error(w, "pool, name and size are required", http.StatusBadRequest)
+		return
+	}
+
+	size, err := strconv.ParseUint(sizeParam, 10, 64)
+	if err != nil || size == 0 {
+		http.Error(w, "size must be a positive integer (bytes)", http.StatusBadRequest)
+		return
+	}
+
+	pool, err := app.Libvirt.LookupStoragePool(poolName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer pool.Free()
+
+	vol, err := app.Libvirt.UploadVolume(pool, name, r.Body, size, app.Log)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer vol.Free()
+
+	app.Log.Infof("volume '%s' uploaded to pool '%s' (%d bytes)", name, poolName, size)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// logHandler streams Hub messages as a sequence of JSON-encoded
+// mulch.Message, one per chunk. This is what mulch-log-client consumes.
+// ?target= and ?types= take comma-separated lists (e.g.
+// "?target=myvm&types=INFO,ERROR") so a caller like
+// `mulch-log-client --vm myvm` only gets that VM's output.
+func (app *App) logHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := &MessageFilter{
+		Types:   splitQueryList(r.URL.Query().Get("types")),
+		Targets: splitQueryList(r.URL.Query().Get("target")),
+	}
+
+	client := app.Hub.Register(r.RemoteAddr, filter)
+	defer client.Unregister()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case msg, ok := <-client.Messages:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// eventsHandler serves the same log stream as logHandler, but as
+// Server-Sent Events (text/event-stream), so a plain browser or
+// `curl -N` can follow it without a custom client. ?type= and ?target=
+// take comma-separated lists to filter by Message.Type and a glob
+// pattern on Message.Target.
+func (app *App) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// The Hub has no message backlog, so a reconnecting client can't be
+	// replayed past where it left off: say so explicitly rather than
+	// silently resuming live, so a consumer knows it may have a gap.
+	w.Header().Set("Mulch-Event-Replay", "unsupported")
+
+	filter := &MessageFilter{
+		Types:   splitQueryList(r.URL.Query().Get("type")),
+		Targets: splitQueryList(r.URL.Query().Get("target")),
+	}
+
+	client := app.Hub.Register(r.RemoteAddr, filter)
+	defer client.Unregister()
+
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		app.Log.Warningf("/events: reconnect from '%s' with Last-Event-ID %s, but replay is not supported, resuming live only", r.RemoteAddr, lastID)
+		fmt.Fprint(w, ": replay not supported, resuming from live messages only\n\n")
+		flusher.Flush()
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	var id uint64
+	for {
+		select {
+		case msg, ok := <-client.Messages:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+
+			id++
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", id, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// splitQueryList splits a comma-separated query parameter into a
+// trimmed, non-empty slice (nil if the parameter is absent)
+func splitQueryList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	parts := strings.Split(value, ",")
+	list := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// poolHandler manages storage pools, user-created and built-in mulch-*
+// alike (none of them is refused):
+// GET lists pools, or shows one pool's info with ?name=
+// POST creates a pool from ?name=&path=&type=&mode=
+// DELETE removes a pool (?name=&wipe=true to also erase its content)
+func (app *App) poolHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		app.poolGet(w, r)
+	case http.MethodPost:
+		app.poolCreate(w, r)
+	case http.MethodDelete:
+		app.poolDelete(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *App) poolGet(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	if name == "" {
+		names, err := app.Libvirt.ListStoragePools()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(names)
+		return
+	}
+
+	info, err := app.Libvirt.GetStoragePoolInfo(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+func (app *App) poolCreate(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	path := r.FormValue("path")
+	poolType := r.FormValue("type")
+	mode := r.FormValue("mode")
+
+	if name == "" || path == "" || poolType == "" {
+		http.Error(w, "name, path and type are required", http.StatusBadRequest)
+		return
+	}
+
+	pool, err := app.Libvirt.CreateStoragePool(name, path, poolType, mode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pool.Free()
+
+	app.Log.Infof("storage pool '%s' created (%s, %s)", name, poolType, path)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (app *App) poolDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	wipe := r.FormValue("wipe") == "true"
+
+	err := app.Libvirt.DeleteStoragePool(name, wipe)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.Log.Infof("storage pool '%s' deleted (wipe=%t)", name, wipe)
+}